@@ -2,9 +2,13 @@ package dpos
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
-	"go-blockchain/event"
+	"go-blockchain/p2p/discover"
 	"io"
 	"io/ioutil"
 	"log"
@@ -12,20 +16,75 @@ import (
 	"path"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"gopkg.in/yaml.v2"
 )
 
+// MaxMessageSize 单条消息允许的最大长度，超过则认为是异常帧
+const MaxMessageSize = 8 << 20 // 8MB
+
+// macSize HMAC-SHA256摘要长度
+const macSize = sha256.Size
+
+// broadcastBufSize 每个对端广播channel的缓冲大小，避免一个慢peer卡住区块生产
+const broadcastBufSize = 32
+
+// lookupInterval 两次主动查找新节点之间的间隔
+const lookupInterval = 30 * time.Second
+
+// Discoverer 是dpos层依赖的节点发现能力，由discover.Table实现
+type Discoverer interface {
+	SelfID() discover.NodeID
+	Lookup(target discover.NodeID) []*discover.Node
+	Subscribe() <-chan *discover.Node
+	MarkStale(id discover.NodeID)
+	Bootstrap(addrs []string)
+	BondedAt(id discover.NodeID, ip net.IP) bool
+}
+
 const (
 	packReqGetID = iota + 1
 	packRspGetID
 	packHeartBeat
 	packBlockData
+	packStatus           // 握手后交换彼此的高度/头哈希
+	packGetBlocks        // 按[FromHeight, FromHeight+Count)窗口请求区块
+	packBlocks           // packGetBlocks的应答
+	packNewBlockAnnounce // 只广播哈希和高度，由接收方按需拉取完整区块
 )
 
+// syncWindow 每次packGetBlocks请求的区块数量上限
+const syncWindow = 128
+
+// syncTimeout 单次同步窗口请求的超时时间
+const syncTimeout = 10 * time.Second
+
+type blockStatus struct {
+	Height   uint64
+	HeadHash string
+}
+
+type getBlocksReq struct {
+	ReqID      uint64
+	FromHeight uint64
+	Count      uint64
+}
+
+type blocksResp struct {
+	ReqID  uint64
+	Blocks []Block
+}
+
+type newBlockAnnounce struct {
+	Hash   string
+	Height uint64
+}
+
 var (
 	errConnClosed = errors.New("connect is closed")
+	errBadMAC     = errors.New("message mac mismatch")
 )
 
 type nodeInfo struct {
@@ -36,7 +95,9 @@ type nodeInfo struct {
 type Config struct {
 	ProduceBlockSlot    uint64
 	ProduceBlocksByTurn uint64
-	Nodes               []nodeInfo
+	Nodes               []nodeInfo // 本地节点用来确定自己监听地址的静态列表
+	BootNodes           []string   // 引导节点地址，仅用来给discover.Table做种，不再是完整拓扑
+	AuthKey             string     // 集群共享的HMAC密钥，用于给消息帧做认证
 }
 
 func GetConfig(filename string) Config {
@@ -56,20 +117,62 @@ func GetConfig(filename string) Config {
 }
 
 type Node struct {
-	ID         string
+	ID         discover.NodeID
 	self       *net.TCPAddr
 	config     Config
 	pool       *connPool
-	broad      *event.Event
+	disc       Discoverer
+	macKey     []byte // 消息帧HMAC密钥，来自config.AuthKey
 	blockChain *BlockChain // 区块链
 	producer   *producer   // 区块生产者
+	sync       *syncState  // 区块同步请求/响应关联
+	reqIDSeq   uint64      // 同步请求ID生成器，原子自增
+	dialing    sync.Map    // 正在拨号或已拨通的节点ID集合，防止lookupLoop重复拨号同一节点
 	exit       chan struct{}
 }
 
+// syncState 维护尚未应答的packGetBlocks请求，按ReqID关联响应，
+// 使得多个同时进行的同步窗口不会互相混淆
+type syncState struct {
+	mux     sync.Mutex
+	pending map[uint64]chan blocksResp
+}
+
+func newSyncState() *syncState {
+	return &syncState{pending: make(map[uint64]chan blocksResp)}
+}
+
+func (s *syncState) register(reqID uint64) chan blocksResp {
+	ch := make(chan blocksResp, 1)
+	s.mux.Lock()
+	s.pending[reqID] = ch
+	s.mux.Unlock()
+	return ch
+}
+
+func (s *syncState) resolve(resp blocksResp) bool {
+	s.mux.Lock()
+	ch, ok := s.pending[resp.ReqID]
+	if ok {
+		delete(s.pending, resp.ReqID)
+	}
+	s.mux.Unlock()
+	if ok {
+		ch <- resp
+	}
+	return ok
+}
+
+func (s *syncState) cancel(reqID uint64) {
+	s.mux.Lock()
+	delete(s.pending, reqID)
+	s.mux.Unlock()
+}
+
 // 消息
 type message struct {
 	MsgTyp byte
-	ID     string
+	ID     discover.NodeID
 	Data   []byte
 }
 
@@ -90,8 +193,32 @@ func decodeMsg(buf []byte) (msg message, err error) {
 	return msg, err
 }
 
-// NewNode 创建一个Node
-func NewNode(idx int, cfg Config) *Node {
+// encodeMsg 将消息编码为JSON并附上HMAC，使伪造的packBlockData等消息能在解码前被丢弃
+func (n *Node) encodeMsg(msg message) []byte {
+	payload := msg.encodeMsg()
+	mac := hmac.New(sha256.New, n.macKey)
+	mac.Write(payload)
+	return append(payload, mac.Sum(nil)...)
+}
+
+// decodeMsg 校验HMAC后再做JSON解码
+func (n *Node) decodeMsg(buf []byte) (message, error) {
+	if len(buf) < macSize {
+		return message{}, errors.New("frame too short")
+	}
+	payload, sum := buf[:len(buf)-macSize], buf[len(buf)-macSize:]
+
+	mac := hmac.New(sha256.New, n.macKey)
+	mac.Write(payload)
+	if !hmac.Equal(sum, mac.Sum(nil)) {
+		return message{}, errBadMAC
+	}
+	return decodeMsg(payload)
+}
+
+// NewNode 创建一个Node。disc为节点发现层，节点的身份(ID)由它派生，
+// 保证TCP握手和discover.Table对同一个节点的认知是一致的。
+func NewNode(idx int, cfg Config, disc Discoverer) *Node {
 	if idx > len(cfg.Nodes) {
 		panic("invalid index: out of range")
 	}
@@ -103,13 +230,15 @@ func NewNode(idx int, cfg Config) *Node {
 	}
 
 	node := &Node{
-		ID:         ninfo.ID,
+		ID:         disc.SelfID(),
 		self:       hostaddr,
 		config:     cfg,
+		disc:       disc,
+		macKey:     []byte(cfg.AuthKey),
+		sync:       newSyncState(),
 		exit:       make(chan struct{}),
 		blockChain: new(BlockChain),
 	}
-	node.broad = new(event.Event)
 	node.pool = newConnPool()
 	node.producer = node.newProducer()
 	return node
@@ -118,7 +247,8 @@ func NewNode(idx int, cfg Config) *Node {
 // Start 启动节点
 func (n *Node) Start() {
 	log.Println("node start:", n.self.String())
-	go n.initConnPool()
+	n.disc.Bootstrap(n.config.BootNodes)
+	go n.lookupLoop()
 	go n.startListen()
 	n.loop()
 }
@@ -142,9 +272,16 @@ func (n *Node) startListen() {
 	}
 }
 
+// remoteIP 取出c对端的IP，供BondedAt核实明文握手里自报的身份
+func remoteIP(c net.Conn) net.IP {
+	if tcpAddr, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		return tcpAddr.IP
+	}
+	return nil
+}
+
 // 处理连接
 func (n *Node) handleAccept(c net.Conn) {
-	buf := make([]byte, 512)
 	defer c.Close()
 
 	rid, err := n.handShakeCheck(c)
@@ -153,22 +290,32 @@ func (n *Node) handleAccept(c net.Conn) {
 		return
 	}
 
+	// rid是对端在明文TCP握手里自报的身份，本身没有任何签名保证，必须
+	// 对照discover层已经完成ping/pong验证的bond记录核实IP，否则任何
+	// 能连上监听端口的人都能冒认别的NodeID抢占connPool里对应的读连接位置
+	if !n.disc.BondedAt(rid, remoteIP(c)) {
+		log.Println("handshake id not bonded, refusing:", c.RemoteAddr(), "claimed", rid)
+		return
+	}
+
 	conn := n.pool.add(rid, 1, c)
+	n.sendStatus(conn)
 	for {
-		err := conn.recv(buf)
-		if err == errConnClosed {
-			// handle close
-			log.Println("closed ", c.RemoteAddr())
+		buf, err := conn.recv()
+		if err != nil {
+			// 无论是对端主动断开还是帧格式错误，流都已经不可信/不可续，
+			// 必须关闭连接而不是continue——否则帧头和正文会永久错位。
+			// rid此时已经过BondedAt核实，标记它待重新验证是安全的
+			log.Println("recv error, closing connection:", c.RemoteAddr(), err)
+			n.disc.MarkStale(rid)
 			break
-		} else if err != nil {
-			continue
 		}
 		n.handleMessage(conn, buf)
 	}
 }
 
 func (n *Node) handleMessage(conn *connection, buf []byte) error {
-	msg, err := decodeMsg(buf)
+	msg, err := n.decodeMsg(buf)
 	if err != nil {
 		log.Println("decode msg error:", err)
 		return err
@@ -177,7 +324,7 @@ func (n *Node) handleMessage(conn *connection, buf []byte) error {
 	case packReqGetID:
 		msg := message{MsgTyp: packRspGetID, ID: n.ID}
 		log.Println("msg:", msg)
-		conn.read.Write(msg.encodeMsg())
+		conn.reply(n.encodeMsg(msg))
 	case packBlockData:
 		// 区块处理
 		//log.Println("msg:", reflect.TypeOf(msg.Data))
@@ -190,25 +337,120 @@ func (n *Node) handleMessage(conn *connection, buf []byte) error {
 		n.blockChain.add(block)
 	case packHeartBeat:
 		// 处理心跳
+	case packStatus:
+		var st blockStatus
+		if err := json.Unmarshal(msg.Data, &st); err != nil {
+			log.Println("status decode:", err)
+			return err
+		}
+		if st.Height > n.blockChain.Height() {
+			go n.syncFrom(conn, st.Height)
+		}
+	case packNewBlockAnnounce:
+		var ann newBlockAnnounce
+		if err := json.Unmarshal(msg.Data, &ann); err != nil {
+			log.Println("announce decode:", err)
+			return err
+		}
+		if ann.Height > n.blockChain.Height() {
+			// 按需拉取，而不是信任直接广播过来的完整区块
+			go n.syncFrom(conn, ann.Height)
+		}
+	case packGetBlocks:
+		var req getBlocksReq
+		if err := json.Unmarshal(msg.Data, &req); err != nil {
+			log.Println("get blocks decode:", err)
+			return err
+		}
+		resp := blocksResp{
+			ReqID:  req.ReqID,
+			Blocks: n.blockChain.Range(req.FromHeight, req.Count),
+		}
+		payload, err := json.Marshal(resp)
+		if err != nil {
+			return err
+		}
+		conn.sendFrame(n.encodeMsg(message{MsgTyp: packBlocks, ID: n.ID, Data: payload}))
+	case packBlocks:
+		var resp blocksResp
+		if err := json.Unmarshal(msg.Data, &resp); err != nil {
+			log.Println("blocks decode:", err)
+			return err
+		}
+		if !n.sync.resolve(resp) {
+			log.Println("sync: unexpected response for reqID", resp.ReqID)
+		}
 	}
 	return nil
 }
 
+// sendStatus 握手完成后双方都应通告各自的高度，省去轮询
+func (n *Node) sendStatus(conn *connection) {
+	st := blockStatus{Height: n.blockChain.Height(), HeadHash: n.blockChain.HeadHash()}
+	payload, err := json.Marshal(st)
+	if err != nil {
+		log.Println("status encode:", err)
+		return
+	}
+	conn.sendFrame(n.encodeMsg(message{MsgTyp: packStatus, ID: n.ID, Data: payload}))
+}
+
+// syncFrom 以syncWindow为步长向对端请求缺失的区块，直到追平peerHeight
+func (n *Node) syncFrom(conn *connection, peerHeight uint64) {
+	for from := n.blockChain.Height() + 1; from <= peerHeight; {
+		remain := peerHeight - from + 1
+		count := uint64(syncWindow)
+		if remain < count {
+			count = remain
+		}
+
+		reqID := atomic.AddUint64(&n.reqIDSeq, 1)
+		respCh := n.sync.register(reqID)
+
+		req := getBlocksReq{ReqID: reqID, FromHeight: from, Count: count}
+		payload, err := json.Marshal(req)
+		if err != nil {
+			n.sync.cancel(reqID)
+			return
+		}
+		conn.sendFrame(n.encodeMsg(message{MsgTyp: packGetBlocks, ID: n.ID, Data: payload}))
+
+		select {
+		case resp := <-respCh:
+			if len(resp.Blocks) == 0 {
+				return // 对端已经没有更多区块了
+			}
+			for _, b := range resp.Blocks {
+				n.blockChain.add(b)
+			}
+			from += uint64(len(resp.Blocks))
+		case <-time.After(syncTimeout):
+			log.Println("sync: request timeout, reqID", reqID)
+			n.sync.cancel(reqID)
+			return
+		case <-n.exit:
+			n.sync.cancel(reqID)
+			return
+		}
+	}
+}
+
 // 握手确认
-func (n *Node) handShakeCheck(c net.Conn) (string, error) {
+func (n *Node) handShakeCheck(c net.Conn) (discover.NodeID, error) {
+	var zero discover.NodeID
 	buf := make([]byte, 256)
 	nbyte, err := c.Read(buf)
 	if err != nil {
-		return "", err
+		return zero, err
 	}
 
 	reqMsg, err := decodeMsg(buf[:nbyte])
 	if err != nil {
-		return "", err
+		return zero, err
 	}
 
 	if reqMsg.MsgTyp != packReqGetID {
-		return "", errors.New("invalid message id")
+		return zero, errors.New("invalid message id")
 	}
 
 	rspMsg := message{MsgTyp: packRspGetID, ID: n.ID}
@@ -217,68 +459,124 @@ func (n *Node) handShakeCheck(c net.Conn) (string, error) {
 }
 
 // 简单的握手
-func (n *Node) handshake(c net.Conn) (string, error) {
+func (n *Node) handshake(c net.Conn) (discover.NodeID, error) {
+	var zero discover.NodeID
 	req := message{MsgTyp: packReqGetID, ID: n.ID}
 	c.Write(req.encodeMsg())
 
 	buf := make([]byte, 256)
 	nbyte, err := c.Read(buf)
 	if err != nil {
-		return "", err
+		return zero, err
 	}
 
 	rsp, err := decodeMsg(buf[:nbyte])
 	if err != nil {
-		return "", nil
+		return zero, nil
 	}
 	log.Println("msgId", rsp.MsgTyp, " id", rsp.ID)
 	if rsp.MsgTyp != packRspGetID {
-		return "", errors.New("invalid response id")
+		return zero, errors.New("invalid response id")
 	}
 	return rsp.ID, nil
 }
 
-// 初始化连接池
-func (n *Node) initConnPool() {
-	for _, ns := range n.config.Nodes {
-		if ns.ID == n.ID {
-			continue
+// lookupLoop 周期性地向discover.Table查找新节点并建立TCP连接，
+// 取代原先基于静态cfg.Nodes的initConnPool
+func (n *Node) lookupLoop() {
+	ticker := time.NewTicker(lookupInterval)
+	defer ticker.Stop()
+
+	n.lookupAndConnect()
+	for {
+		select {
+		case <-n.exit:
+			return
+		case nd, ok := <-n.disc.Subscribe():
+			if !ok {
+				continue
+			}
+			go n.dialDiscovered(nd)
+		case <-ticker.C:
+			n.lookupAndConnect()
 		}
-		go n.connect(ns)
 	}
 }
 
-func (n *Node) connect(ninfo nodeInfo) {
-	var c net.Conn
-	var err error
-	for {
-		c, err = net.DialTimeout("tcp", ninfo.Addr, 30*time.Second)
-		if err != nil {
-			//log.Println("dial error:", err)
-			time.Sleep(1 * time.Second)
+// lookupAndConnect 对自身ID及若干随机目标做查找，拉取新节点并拨号
+func (n *Node) lookupAndConnect() {
+	targets := append([]discover.NodeID{n.ID}, randomNodeIDs(3)...)
+	for _, target := range targets {
+		for _, nd := range n.disc.Lookup(target) {
+			go n.dialDiscovered(nd)
+		}
+	}
+}
+
+func randomNodeIDs(count int) []discover.NodeID {
+	ids := make([]discover.NodeID, 0, count)
+	for i := 0; i < count; i++ {
+		var id discover.NodeID
+		if _, err := rand.Read(id[:]); err != nil {
 			continue
 		}
-		break
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// dialDiscovered 向discover.Table发现的新节点发起TCP连接并完成既有的握手流程
+func (n *Node) dialDiscovered(nd *discover.Node) {
+	if n.pool.dialed(nd.ID) {
+		// 已经有一路拨号连接，lookupLoop的周期查找/Subscribe可能重复发现同一个节点
+		return
+	}
+	if _, dialing := n.dialing.LoadOrStore(nd.ID, struct{}{}); dialing {
+		// 已经有goroutine在拨这个节点，避免并发重复拨号
+		return
+	}
+	defer n.dialing.Delete(nd.ID)
+
+	addr := net.TCPAddr{IP: nd.IP, Port: nd.TCPPort}
+	c, err := net.DialTimeout("tcp", addr.String(), 30*time.Second)
+	if err != nil {
+		log.Println("dial discovered node error:", addr.String(), err)
+		return
 	}
 
-	log.Println("connect to", ninfo.Addr, "ok")
+	log.Println("connect to", addr.String(), "ok")
 	defer c.Close()
 
 	rid, err := n.handshake(c)
 	if err != nil {
 		log.Println("handshake fail:", err)
+		n.disc.MarkStale(nd.ID)
+		return
+	}
+	if rid != nd.ID {
+		// 对端在明文握手里自报的身份和discover层验证过的nd.ID对不上，
+		// 这个地址上可能换了人，或者有人在冒充nd，绝不能并入连接池——
+		// 否则connPool就会在nd.ID这个可信身份下挂着一个连着别人的socket
+		log.Println("handshake id mismatch, want", nd.ID, "got", rid)
+		n.disc.MarkStale(nd.ID)
 		return
 	}
-	conn := n.pool.add(rid, 2, c)
-	// 订阅事件
-	n.broad.Subcribe(conn.broadcast)
+	conn := n.pool.add(nd.ID, 2, c)
+	n.sendStatus(conn)
 	for {
 		select {
 		case <-n.exit:
 			return
 		case msg := <-conn.broadcast:
-			data := msg.encodeMsg()
-			conn.send(data)
+			if err := conn.send(n.encodeMsg(msg)); err != nil {
+				// 写失败说明这路拨号连接已经死了，既有的dialed()检查只看
+				// writable标志，不会自己发现——不清理的话这个peer会一直
+				// 被当作"已连接"，永远等不到lookupLoop重新拨号
+				log.Println("send to", addr.String(), "failed, dropping peer:", err)
+				n.pool.clearWrite(nd.ID, c)
+				n.disc.MarkStale(nd.ID)
+				return
+			}
 		}
 	}
 }
@@ -290,12 +588,19 @@ func (n *Node) loop() {
 		case <-n.exit:
 			n.producer.exit <- struct{}{}
 			return
-		case b := <-n.producer.blockCh: // 通过TCP广播数据
-			log.Println("produce block and broadcast")
+		case b := <-n.producer.blockCh:
+			log.Println("produce block and announce")
 			b.SignBlock() // 签名
-			msg := message{MsgTyp: packBlockData, ID: n.ID, Data: b.Encode()}
-			n.broad.Send(msg)
 			n.blockChain.pending(*b)
+			// 只广播哈希和高度，由对端发现自己落后时按packGetBlocks主动拉取，
+			// 而不是把完整区块数据塞给每一个peer
+			ann := newBlockAnnounce{Hash: n.blockChain.HeadHash(), Height: n.blockChain.Height()}
+			payload, err := json.Marshal(ann)
+			if err != nil {
+				log.Println("announce encode:", err)
+				continue
+			}
+			n.pool.broadcast(message{MsgTyp: packNewBlockAnnounce, ID: n.ID, Data: payload})
 		}
 	}
 }
@@ -315,16 +620,26 @@ func packingData(typ byte, id string, data []byte) []byte {
 
 type connPool struct {
 	mux sync.Mutex
-	set map[string]*connection
+	set map[discover.NodeID]*connection
 }
 
 func newConnPool() *connPool {
 	return &connPool{
-		set: make(map[string]*connection),
+		set: make(map[discover.NodeID]*connection),
 	}
 }
 
-func (cp *connPool) add(id string, ctyp int, c net.Conn) *connection {
+// dialed 判断该节点是否已经有一路主动拨号建立的连接，避免重复拨号
+// 造成socket泄漏和broadcast channel被重复订阅
+func (cp *connPool) dialed(id discover.NodeID) bool {
+	cp.mux.Lock()
+	defer cp.mux.Unlock()
+	conn, ok := cp.set[id]
+	return ok && conn.writable
+}
+
+// add 以发现层的NodeID为key，保证TCP连接池和discover.Table认的是同一个节点
+func (cp *connPool) add(id discover.NodeID, ctyp int, c net.Conn) *connection {
 	cp.mux.Lock()
 	defer cp.mux.Unlock()
 	var conn *connection
@@ -332,13 +647,21 @@ func (cp *connPool) add(id string, ctyp int, c net.Conn) *connection {
 	conn, ok = cp.set[id]
 	if !ok {
 		conn = new(connection)
-		conn.broadcast = make(chan message)
+		// 带缓冲只是让偶发的抖动不会立刻触发丢包，真正防止慢peer卡住
+		// 区块生产的是broadcast里的非阻塞发送
+		conn.broadcast = make(chan message, broadcastBufSize)
 	}
 	if ctyp == 1 {
+		if conn.readable && conn.read != c {
+			conn.read.Close()
+		}
 		conn.read = c
 		conn.readable = true
 	}
 	if ctyp == 2 {
+		if conn.writable && conn.write != c {
+			conn.write.Close()
+		}
 		conn.write = c
 		conn.writable = true
 	}
@@ -346,6 +669,37 @@ func (cp *connPool) add(id string, ctyp int, c net.Conn) *connection {
 	return conn
 }
 
+// clearWrite 关闭并清除id对应的写连接，让dialed()重新报告未连接，
+// 使dialDiscovered发现的死连接能被lookupLoop后续的拨号替换掉
+func (cp *connPool) clearWrite(id discover.NodeID, c net.Conn) {
+	cp.mux.Lock()
+	defer cp.mux.Unlock()
+	conn, ok := cp.set[id]
+	if !ok || conn.write != c {
+		return
+	}
+	conn.write.Close()
+	conn.write = nil
+	conn.writable = false
+}
+
+// broadcast 把msg非阻塞地投给每一个已连接的对端：channel满了就丢弃这条给
+// 该peer的广播，而不是阻塞调用方（区块生产）去等一个慢peer腾出空间
+func (cp *connPool) broadcast(msg message) {
+	cp.mux.Lock()
+	defer cp.mux.Unlock()
+	for id, conn := range cp.set {
+		if !conn.writable {
+			continue
+		}
+		select {
+		case conn.broadcast <- msg:
+		default:
+			log.Println("broadcast: peer channel full, dropping message for", id)
+		}
+	}
+}
+
 type connection struct {
 	read      net.Conn // 读取
 	readable  bool
@@ -355,25 +709,74 @@ type connection struct {
 	broadcast chan message
 }
 
-func (c connection) send(data []byte) error {
-	if c.writable {
-		_, err := c.write.Write(data)
+// writeFrame 以4字节大端长度前缀为帧写出data
+func writeFrame(w net.Conn, data []byte) error {
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(len(data)))
+	if _, err := w.Write(header); err != nil {
 		return err
 	}
-	return errors.New("conn is unwritable")
+	_, err := w.Write(data)
+	return err
 }
 
-func (c connection) recv(data []byte) error {
-	if c.readable {
-		n, err := c.read.Read(data)
-		if err != nil && err != io.EOF {
-			return err
-		}
-		if err == io.EOF {
-			return errConnClosed
+// send 通过主动拨号建立的那一路socket发送广播消息
+func (c connection) send(data []byte) error {
+	if !c.writable {
+		return errors.New("conn is unwritable")
+	}
+	return writeFrame(c.write, data)
+}
+
+// reply 通过对端拨入、被我们accept的那一路socket直接回复，
+// 请求/响应式的协议消息用这个，不依赖我们是否也拨号连接了对方
+func (c connection) reply(data []byte) error {
+	if !c.readable {
+		return errors.New("conn is unreadale")
+	}
+	return writeFrame(c.read, data)
+}
+
+// sendFrame 优先走已拨号的socket，没有的话退化为在accept的socket上回写，
+// 用于status/同步等双方都可能发起的请求响应式消息
+func (c connection) sendFrame(data []byte) error {
+	if c.writable {
+		if err := writeFrame(c.write, data); err == nil {
+			return nil
 		}
-		data = data[:n]
-		return nil
 	}
-	return errors.New("conn is unreadale")
+	if c.readable {
+		return writeFrame(c.read, data)
+	}
+	return errors.New("no socket available")
+}
+
+// recv 读取一个完整的长度前缀帧，不再像之前那样用固定512字节缓冲区截断消息
+func (c connection) recv() ([]byte, error) {
+	if !c.readable {
+		return nil, errors.New("conn is unreadale")
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(c.read, header); err != nil {
+		return nil, toConnErr(err)
+	}
+
+	length := binary.BigEndian.Uint32(header)
+	if length == 0 || length > MaxMessageSize {
+		return nil, errors.New("invalid frame length")
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(c.read, body); err != nil {
+		return nil, toConnErr(err)
+	}
+	return body, nil
+}
+
+func toConnErr(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errConnClosed
+	}
+	return err
 }
@@ -0,0 +1,94 @@
+package dpos
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// TestConnectionFraming 校验length-prefix帧能正确传输超过旧512字节缓冲区上限的数据
+func TestConnectionFraming(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	sendConn := connection{write: client, writable: true}
+	recvConn := connection{read: server, readable: true}
+
+	payload := bytes.Repeat([]byte("block-data-"), 1000) // 约11KB，远超旧的512字节缓冲区
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- sendConn.send(payload)
+	}()
+
+	got, err := recvConn.recv()
+	if err != nil {
+		t.Fatalf("recv error: %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("send error: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("recv payload mismatch: got %d bytes, want %d bytes", len(got), len(payload))
+	}
+}
+
+func TestConnectionRecvClosed(t *testing.T) {
+	client, server := net.Pipe()
+	recvConn := connection{read: server, readable: true}
+
+	client.Close()
+
+	if _, err := recvConn.recv(); err != errConnClosed {
+		t.Fatalf("expected errConnClosed, got %v", err)
+	}
+}
+
+func TestNodeEncodeDecodeMsg(t *testing.T) {
+	n := &Node{macKey: []byte("cluster-shared-secret")}
+
+	msg := message{MsgTyp: packBlockData, Data: []byte("hello")}
+	frame := n.encodeMsg(msg)
+
+	got, err := n.decodeMsg(frame)
+	if err != nil {
+		t.Fatalf("decodeMsg error: %v", err)
+	}
+	if got.MsgTyp != msg.MsgTyp || !bytes.Equal(got.Data, msg.Data) {
+		t.Fatalf("decoded message mismatch: got %+v", got)
+	}
+
+	frame[len(frame)-1] ^= 0xFF // 篡改MAC
+	if _, err := n.decodeMsg(frame); err != errBadMAC {
+		t.Fatalf("expected errBadMAC, got %v", err)
+	}
+}
+
+func TestSyncStateResolve(t *testing.T) {
+	s := newSyncState()
+	ch := s.register(1)
+
+	if s.resolve(blocksResp{ReqID: 2, Blocks: []Block{{}}}) {
+		t.Fatalf("resolve should not match an unregistered reqID")
+	}
+
+	resp := blocksResp{ReqID: 1, Blocks: []Block{{}, {}}}
+	if !s.resolve(resp) {
+		t.Fatalf("resolve should match the registered reqID")
+	}
+
+	select {
+	case got := <-ch:
+		if len(got.Blocks) != 2 {
+			t.Fatalf("expected 2 blocks, got %d", len(got.Blocks))
+		}
+	default:
+		t.Fatal("expected response to be delivered to the registered channel")
+	}
+
+	// 已经resolve过的reqID应该已被清理，不会重复匹配
+	if s.resolve(resp) {
+		t.Fatalf("resolve should not match an already-resolved reqID")
+	}
+}
@@ -0,0 +1,553 @@
+package discover
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math/bits"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// bondExpiration 认证过的节点在此时间内可以直接复用，无需重新ping
+const bondExpiration = 24 * time.Hour
+
+// NodeID 节点标识，即对端公钥的哈希
+type NodeID [32]byte
+
+// StringID 由任意字符串生成一个NodeID，供bootnode等场景手工指定标识使用
+func StringID(s string) NodeID {
+	return NodeID(sha256.Sum256([]byte(s)))
+}
+
+// PubkeyToNodeID 由公钥派生NodeID
+func PubkeyToNodeID(pub *ecdsa.PublicKey) NodeID {
+	pubBytes := elliptic.Marshal(pub.Curve, pub.X, pub.Y)
+	return NodeID(sha256.Sum256(pubBytes[1:])) // 去掉0x04前缀
+}
+
+// Config discover模块的配置
+type Config struct {
+	Laddr      string
+	TCPPort    int // 本地业务层TCP监听端口，随ping/pong告知对端，供其发起真实的TCP连接
+	PrivateKey *ecdsa.PrivateKey
+	NodeDBPath string // 路由表持久化文件，留空则不持久化
+}
+
+// Node 远端节点信息
+type Node struct {
+	ID      NodeID
+	IP      net.IP
+	UDPPort int
+	TCPPort int
+
+	lastPong int64 // 最近一次收到pong的时间戳(unix秒)，原子访问
+}
+
+// NewNode 创建一个Node
+func NewNode(id NodeID, ip net.IP, udpPort, tcpPort int) *Node {
+	return &Node{ID: id, IP: ip, UDPPort: udpPort, TCPPort: tcpPort}
+}
+
+// Validate 校验node的基本信息是否可用
+func (n *Node) Validate() bool {
+	return n.IP != nil && n.UDPPort > 0
+}
+
+func (n *Node) bonded() bool {
+	last := atomic.LoadInt64(&n.lastPong)
+	if last == 0 {
+		return false
+	}
+	return time.Now().Unix()-last < int64(bondExpiration/time.Second)
+}
+
+const (
+	bucketCount          = len(NodeID{}) * 8 // 每个bit一个桶，即256个桶
+	bucketSize           = 16                // k
+	replacementCacheSize = 10
+	refreshInterval      = 30 * time.Minute
+	revalidateInterval   = 10 * time.Second
+)
+
+// kbucket 一个k桶：entries按"最近一次见到"的顺序排列，最老的在最前面；
+// replacements是entries满了之后排队等待上位的候补节点
+type kbucket struct {
+	entries      []*Node
+	replacements []*Node
+}
+
+// pinger 是Table对底层UDP传输的依赖面，真正的实现是*udp；
+// 抽成接口是为了单元测试能换上一个不需要真实网络的桩实现
+type pinger interface {
+	ping(addr *net.UDPAddr) (int, NodeID, error)
+	findnode(addr *net.UDPAddr, target NodeID) []*Node
+}
+
+// Table 基于Kademlia的路由表：256个按XOR距离分桶的k桶，
+// 定期refresh填充稀疏的桶，定期revalidate探活最老的条目。
+type Table struct {
+	mux     sync.Mutex
+	self    pinger
+	localID NodeID
+	buckets [bucketCount]*kbucket
+	byID    map[NodeID]*Node // 加速按ID查找，与buckets保持同步
+
+	bonded       chan *Node // 新完成bond的节点，供上层(如dpos)订阅后建立业务连接
+	dbPath       string
+	persistedIDs map[NodeID]struct{} // 已经写进dbPath的id，避免同一个节点被反复追加
+	exit         chan struct{}
+	closeOne     sync.Once
+}
+
+func newTable(u *udp, cfg Config) *Table {
+	tab := &Table{
+		self:         u,
+		localID:      u.Id,
+		byID:         make(map[NodeID]*Node),
+		bonded:       make(chan *Node, 32),
+		dbPath:       cfg.NodeDBPath,
+		persistedIDs: make(map[NodeID]struct{}),
+		exit:         make(chan struct{}),
+	}
+	for i := range tab.buckets {
+		tab.buckets[i] = &kbucket{}
+	}
+
+	tab.loadSeeds()
+
+	go tab.refreshLoop()
+	go tab.revalidateLoop()
+	return tab
+}
+
+// close 停止refresh/revalidate后台协程
+func (tab *Table) close() {
+	tab.closeOne.Do(func() { close(tab.exit) })
+}
+
+// xor 计算a、b的异或距离
+func xor(a, b NodeID) NodeID {
+	var r NodeID
+	for i := range a {
+		r[i] = a[i] ^ b[i]
+	}
+	return r
+}
+
+// logdist 返回a、b之间的对数距离，即256-leadingZeroBits(xor(a,b))。
+// 两个id相同时返回0。
+func logdist(a, b NodeID) int {
+	d := xor(a, b)
+	for i, v := range d {
+		if v != 0 {
+			return (len(d)-i)*8 - bits.LeadingZeros8(v)
+		}
+	}
+	return 0
+}
+
+// bucketIndex 返回id相对本地节点应该落入的桶下标
+func (tab *Table) bucketIndex(id NodeID) int {
+	dist := logdist(tab.localID, id)
+	if dist == 0 {
+		dist = 1 // 与自己相同的id不应该发生，兜底放进最近的桶
+	}
+	return dist - 1
+}
+
+// bondNode 将已经通过ping/pong验证的节点加入对应的k桶，
+// 桶未满直接插入；桶已满则去挑战最久未见的条目，挑战者暂存进replacement cache。
+func (tab *Table) bondNode(n *Node) {
+	if n.ID == tab.localID {
+		return
+	}
+
+	idx := tab.bucketIndex(n.ID)
+	b := tab.buckets[idx]
+
+	tab.mux.Lock()
+	for i, e := range b.entries {
+		if e.ID == n.ID {
+			// 已存在，移到队尾表示最近见过
+			b.entries = append(b.entries[:i], b.entries[i+1:]...)
+			b.entries = append(b.entries, n)
+			tab.byID[n.ID] = n
+			tab.mux.Unlock()
+			tab.persist(n)
+			tab.notifyBonded(n)
+			return
+		}
+	}
+
+	if len(b.entries) < bucketSize {
+		b.entries = append(b.entries, n)
+		tab.byID[n.ID] = n
+		tab.mux.Unlock()
+		tab.persist(n)
+		tab.notifyBonded(n)
+		return
+	}
+
+	oldest := b.entries[0]
+	b.replacements = append(b.replacements, n)
+	if len(b.replacements) > replacementCacheSize {
+		b.replacements = b.replacements[1:]
+	}
+	tab.mux.Unlock()
+
+	go tab.challenge(idx, oldest)
+}
+
+// challenge ping桶里最久未见的条目，超时才淘汰它并换上replacement cache中排队最久的节点
+func (tab *Table) challenge(bucketIdx int, oldest *Node) {
+	addr := &net.UDPAddr{IP: oldest.IP, Port: oldest.UDPPort}
+	b := tab.buckets[bucketIdx]
+
+	if _, _, err := tab.self.ping(addr); err == nil {
+		// oldest仍然存活，丢弃这次的挑战者
+		tab.mux.Lock()
+		if len(b.replacements) > 0 {
+			b.replacements = b.replacements[:len(b.replacements)-1]
+		}
+		tab.mux.Unlock()
+		return
+	}
+
+	tab.mux.Lock()
+	if len(b.entries) > 0 && b.entries[0].ID == oldest.ID {
+		b.entries = b.entries[1:]
+		delete(tab.byID, oldest.ID)
+	}
+	var next *Node
+	if len(b.replacements) > 0 {
+		next = b.replacements[0]
+		b.replacements = b.replacements[1:]
+		b.entries = append(b.entries, next)
+		tab.byID[next.ID] = next
+	}
+	tab.mux.Unlock()
+
+	// persist自己会加tab.mux，必须在释放锁之后调用
+	if next != nil {
+		tab.persist(next)
+		tab.notifyBonded(next)
+	}
+}
+
+func (tab *Table) notifyBonded(n *Node) {
+	select {
+	case tab.bonded <- n:
+	default:
+		// 订阅者处理不及时就丢弃，lookupLoop下一轮还会再次发现该节点
+	}
+}
+
+// closest 返回路由表中已知的、按到target的XOR距离由近到远排序的前n个节点
+func (tab *Table) closest(target NodeID, n int) []*Node {
+	tab.mux.Lock()
+	all := make([]*Node, 0, len(tab.byID))
+	for _, nd := range tab.byID {
+		all = append(all, nd)
+	}
+	tab.mux.Unlock()
+
+	sort.Slice(all, func(i, j int) bool {
+		di, dj := xor(target, all[i].ID), xor(target, all[j].ID)
+		return bytes.Compare(di[:], dj[:]) < 0
+	})
+	if len(all) > n {
+		all = all[:n]
+	}
+	return all
+}
+
+// SelfID 返回本地节点的身份
+func (tab *Table) SelfID() NodeID {
+	return tab.localID
+}
+
+// Lookup 查找距离target最近的一批节点：先看本地路由表，
+// 再向本地已知的最近节点发一轮findnode补充新节点
+func (tab *Table) Lookup(target NodeID) []*Node {
+	local := tab.closest(target, bucketSize)
+	for _, nd := range local {
+		if nd.ID == tab.localID {
+			continue
+		}
+		addr := &net.UDPAddr{IP: nd.IP, Port: nd.UDPPort}
+		tab.self.findnode(addr, target)
+	}
+	return tab.closest(target, bucketSize)
+}
+
+// Subscribe 订阅新完成bond的节点
+func (tab *Table) Subscribe() <-chan *Node {
+	return tab.bonded
+}
+
+// MarkStale 将节点标记为待重新验证，下一次bond会重新发起ping
+func (tab *Table) MarkStale(id NodeID) {
+	tab.mux.Lock()
+	defer tab.mux.Unlock()
+	if n, ok := tab.byID[id]; ok {
+		atomic.StoreInt64(&n.lastPong, 0)
+	}
+}
+
+func (tab *Table) findByID(id NodeID) (*Node, bool) {
+	tab.mux.Lock()
+	defer tab.mux.Unlock()
+	n, ok := tab.byID[id]
+	return n, ok
+}
+
+// BondedAt 判断id是否已经通过discovery的ping/pong完成bond且尚未过期，
+// 且记录在案的IP与ip一致。供上层(比如dpos接受入站TCP连接时)核实对端
+// 自报的身份，而不是盲目信任一个从未经过签名验证的id
+func (tab *Table) BondedAt(id NodeID, ip net.IP) bool {
+	n, ok := tab.findByID(id)
+	if !ok || ip == nil {
+		return false
+	}
+	return n.bonded() && n.IP.Equal(ip)
+}
+
+// bond 确保对端经过ping/pong验证之后才加入路由表。
+// bondExpiration内已经验证过的节点直接复用，避免每次都重新握手。
+// id是调用方认定的身份(比如Bootstrap阶段的StringID(addr)占位符，或者
+// 别的节点在replynode里转述来的邻居id)，只用来判断能否免去重复握手；
+// 真正写入路由表的身份永远是ping从签名里验证出来的realID。
+func (tab *Table) bond(id NodeID, addr *net.UDPAddr) *Node {
+	if n, ok := tab.findByID(id); ok && n.bonded() {
+		return n
+	}
+
+	tcpPort, realID, err := tab.self.ping(addr)
+	if err != nil {
+		log.Println("bond: ping fail", addr, err)
+		return nil
+	}
+	if tcpPort == 0 {
+		// 对端没有告知真实的业务端口，退化为假设跟发现端口相同
+		tcpPort = addr.Port
+	}
+
+	if realID != id {
+		// 验证过的身份跟我们原先认定的不一致，说明id只是占位符或者
+		// 过期/不准确的转述信息，丢掉那条旧记录，只信任realID
+		tab.forget(id)
+	}
+
+	n := NewNode(realID, addr.IP, addr.Port, tcpPort)
+	atomic.StoreInt64(&n.lastPong, time.Now().Unix())
+	tab.bondNode(n)
+	return n
+}
+
+// forget 从路由表中移除id对应的条目(如果存在)，供bond()在识别出真实
+// 身份之后清理被取代的占位/过期记录
+func (tab *Table) forget(id NodeID) {
+	tab.mux.Lock()
+	defer tab.mux.Unlock()
+	if _, ok := tab.byID[id]; !ok {
+		return
+	}
+	b := tab.buckets[tab.bucketIndex(id)]
+	for i, e := range b.entries {
+		if e.ID == id {
+			b.entries = append(b.entries[:i], b.entries[i+1:]...)
+			break
+		}
+	}
+	delete(tab.byID, id)
+}
+
+// Bootstrap 使用手工配置的引导节点地址为路由表做种。这些地址只是UDP端点，
+// 尚不知道对方真实的NodeID，先以StringID(addr)当作占位身份发起bond；
+// bond内部ping通过后会从pong的签名里恢复出对端真实的NodeID，一旦它跟
+// 占位符不同就会删掉占位记录、改用真实身份重新插入，所以这条记录最终
+// 是以对方自己的真实NodeID留在表里的。
+func (tab *Table) Bootstrap(addrs []string) {
+	for _, addr := range addrs {
+		addr := addr
+		go func() {
+			udpAddr, err := net.ResolveUDPAddr("udp", addr)
+			if err != nil {
+				log.Println("bootstrap: resolve error", addr, err)
+				return
+			}
+			tab.bond(StringID(addr), udpAddr)
+		}()
+	}
+}
+
+// recordPong 刷新已存在节点的最近一次pong时间
+func (tab *Table) recordPong(id NodeID) {
+	if n, ok := tab.findByID(id); ok {
+		atomic.StoreInt64(&n.lastPong, time.Now().Unix())
+	}
+}
+
+// refreshLoop 启动时立即做一次自查找，此后每refreshInterval对自身和若干随机目标做查找，
+// 填充稀疏的桶
+func (tab *Table) refreshLoop() {
+	tab.doRefresh()
+
+	ticker := time.NewTicker(refreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-tab.exit:
+			return
+		case <-ticker.C:
+			tab.doRefresh()
+		}
+	}
+}
+
+func (tab *Table) doRefresh() {
+	tab.Lookup(tab.localID)
+	for i := 0; i < 3; i++ {
+		var target NodeID
+		if _, err := rand.Read(target[:]); err != nil {
+			continue
+		}
+		tab.Lookup(target)
+	}
+}
+
+// revalidateLoop 每revalidateInterval从一个随机非空桶里挑最老的条目ping一次，保持活性
+func (tab *Table) revalidateLoop() {
+	ticker := time.NewTicker(revalidateInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-tab.exit:
+			return
+		case <-ticker.C:
+			tab.revalidateOldest()
+		}
+	}
+}
+
+func (tab *Table) revalidateOldest() {
+	tab.mux.Lock()
+	var candidates []int
+	for i, b := range tab.buckets {
+		if len(b.entries) > 0 {
+			candidates = append(candidates, i)
+		}
+	}
+	if len(candidates) == 0 {
+		tab.mux.Unlock()
+		return
+	}
+	var r [1]byte
+	rand.Read(r[:])
+	idx := candidates[int(r[0])%len(candidates)]
+	oldest := tab.buckets[idx].entries[0]
+	tab.mux.Unlock()
+
+	go tab.challenge(idx, oldest)
+}
+
+// --- 持久化：简单的追加写文件，每行一个已bond的节点 ---
+
+// persist 把n追加写进dbPath，但每个id只写一次：bond()在bondExpiration
+// (24h)后会对同一个长期在线的peer重新走一遍完整流程并再次调用persist，
+// 如果每次都追加，文件会越积越多同一个id的行，重启时loadSeeds会把
+// 同一个id塞进同一个bucket好几次，白白占掉本就有限的16个槽位
+func (tab *Table) persist(n *Node) {
+	if tab.dbPath == "" {
+		return
+	}
+
+	tab.mux.Lock()
+	if _, ok := tab.persistedIDs[n.ID]; ok {
+		tab.mux.Unlock()
+		return
+	}
+	tab.persistedIDs[n.ID] = struct{}{}
+	tab.mux.Unlock()
+
+	f, err := os.OpenFile(tab.dbPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Println("table persist: open error", err)
+		return
+	}
+	defer f.Close()
+
+	line := fmt.Sprintf("%s %s %d %d\n", hex.EncodeToString(n.ID[:]), n.IP.String(), n.UDPPort, n.TCPPort)
+	if _, err := f.WriteString(line); err != nil {
+		log.Println("table persist: write error", err)
+	}
+}
+
+// loadSeeds 从持久化文件里恢复之前见过的节点。这些节点lastPong为0，
+// 即视为未bond，重启后第一次用到时会重新ping一次，而不需要从零开始重新发现
+func (tab *Table) loadSeeds() {
+	if tab.dbPath == "" {
+		return
+	}
+	f, err := os.Open(tab.dbPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("table loadSeeds: open error", err)
+		}
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 4 {
+			continue
+		}
+		idBytes, err := hex.DecodeString(fields[0])
+		if err != nil || len(idBytes) != len(NodeID{}) {
+			continue
+		}
+		var id NodeID
+		copy(id[:], idBytes)
+
+		ip := net.ParseIP(fields[1])
+		udpPort, err1 := strconv.Atoi(fields[2])
+		tcpPort, err2 := strconv.Atoi(fields[3])
+		if ip == nil || err1 != nil || err2 != nil {
+			continue
+		}
+
+		// 旧版本可能在同一个id上重复persist过，文件里会有好几行同样的id；
+		// 这里只保留第一条占用bucket槽位，其余的当成已经在磁盘上，不再
+		// 重复插入——否则同一个逻辑节点会占掉bucket里好几个本就有限的槽位
+		tab.persistedIDs[id] = struct{}{}
+		if _, exists := tab.byID[id]; exists {
+			continue
+		}
+
+		n := NewNode(id, ip, udpPort, tcpPort)
+		idx := tab.bucketIndex(id)
+		b := tab.buckets[idx]
+		if len(b.entries) < bucketSize {
+			b.entries = append(b.entries, n)
+			tab.byID[id] = n
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Println("table loadSeeds: scan error", err)
+	}
+}
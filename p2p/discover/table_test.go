@@ -0,0 +1,229 @@
+package discover
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// idWithPrefix 构造一个高位leadingZeroBits个0bit，第leadingZeroBits位置1的NodeID，
+// 用来精确控制与all-zero本地ID之间的对数距离(=256-leadingZeroBits)
+func idWithPrefix(leadingZeroBits int) NodeID {
+	var id NodeID
+	if leadingZeroBits >= len(id)*8 {
+		return id
+	}
+	byteIdx := leadingZeroBits / 8
+	bitIdx := 7 - uint(leadingZeroBits%8)
+	id[byteIdx] = 1 << bitIdx
+	return id
+}
+
+// blockingPinger 桩实现：ping永远不返回，模拟一个发了ping但从没等到
+// 对应pong的对端。桶满时bondNode会另起一个goroutine调用tab.self.ping
+// (见challenge)，而测试在bondNode同步返回后立刻做断言，根本不等这个
+// 挑战goroutine的结果——用一个真实、但永远阻塞的self，既不会是nil让
+// challenge panic，也不会在断言之前抢先跑完改掉桶的状态。
+type blockingPinger struct{}
+
+func (blockingPinger) ping(addr *net.UDPAddr) (int, NodeID, error) {
+	select {}
+}
+
+func (blockingPinger) findnode(addr *net.UDPAddr, target NodeID) []*Node {
+	return nil
+}
+
+// failingPinger 桩实现：ping立刻失败，模拟对端已经下线，用来确定性地
+// 驱动challenge()的淘汰分支，而不必像blockingPinger那样永远等不到结果
+type failingPinger struct{}
+
+func (failingPinger) ping(addr *net.UDPAddr) (int, NodeID, error) {
+	return 0, NodeID{}, errPacketTimeout
+}
+
+func (failingPinger) findnode(addr *net.UDPAddr, target NodeID) []*Node {
+	return nil
+}
+
+func newTestTable() *Table {
+	var local NodeID // 全0，方便logdist(local, idWithPrefix(k)) == 256-k
+	return &Table{
+		self:    blockingPinger{},
+		localID: local,
+		byID:    make(map[NodeID]*Node),
+		bonded:  make(chan *Node, 32),
+		exit:    make(chan struct{}),
+	}
+}
+
+// newInitializedTestTable 在newTestTable的基础上补上buckets，
+// 跳过newTable里依赖真实udp连接的初始化逻辑(refresh/revalidate/persist)
+func newInitializedTestTable() *Table {
+	tab := newTestTable()
+	for i := range tab.buckets {
+		tab.buckets[i] = &kbucket{}
+	}
+	return tab
+}
+
+func TestLogdistBoundaries(t *testing.T) {
+	var local NodeID
+	cases := []struct {
+		leadingZeros int
+		wantDist     int
+	}{
+		{0, 256},
+		{1, 255},
+		{255, 1},
+	}
+	for _, c := range cases {
+		id := idWithPrefix(c.leadingZeros)
+		if got := logdist(local, id); got != c.wantDist {
+			t.Fatalf("logdist with %d leading zero bits: got %d, want %d", c.leadingZeros, got, c.wantDist)
+		}
+	}
+}
+
+func TestBucketIndexBoundaries(t *testing.T) {
+	tab := newInitializedTestTable()
+
+	// leadingZeros=0 => dist=256 => bucket 255 (最远的桶)
+	farID := idWithPrefix(0)
+	if idx := tab.bucketIndex(farID); idx != bucketCount-1 {
+		t.Fatalf("expected farthest id in bucket %d, got %d", bucketCount-1, idx)
+	}
+
+	// leadingZeros=255 => dist=1 => bucket 0 (最近的桶)
+	nearID := idWithPrefix(255)
+	if idx := tab.bucketIndex(nearID); idx != 0 {
+		t.Fatalf("expected nearest id in bucket 0, got %d", idx)
+	}
+}
+
+func TestBondNodeFillsBucketThenReplaces(t *testing.T) {
+	tab := newInitializedTestTable()
+
+	// 所有节点落入同一个桶(leadingZeros=248 => bucket 7)，
+	// 用最高位固定该桶，再用同一字节的低7位区分出不同ID而不改变leading zero计数
+	bucketID := idWithPrefix(248)
+	bucketIdx := tab.bucketIndex(bucketID)
+
+	// 填满bucketSize个条目
+	for i := 0; i < bucketSize; i++ {
+		id := bucketID
+		id[len(id)-1] |= byte(i + 1) // 低位区分，不影响最高位，桶不变
+		n := NewNode(id, net.ParseIP("127.0.0.1"), 30000+i, 40000+i)
+		tab.bondNode(n)
+	}
+
+	b := tab.buckets[bucketIdx]
+	if len(b.entries) != bucketSize {
+		t.Fatalf("expected bucket full with %d entries, got %d", bucketSize, len(b.entries))
+	}
+	if len(tab.byID) != bucketSize {
+		t.Fatalf("expected %d nodes indexed by id, got %d", bucketSize, len(tab.byID))
+	}
+
+	// 桶已满，再插入一个新节点应该进入replacement cache而不是entries
+	extraID := bucketID
+	extraID[len(extraID)-1] |= byte(bucketSize + 1)
+	extra := NewNode(extraID, net.ParseIP("127.0.0.1"), 39999, 49999)
+	tab.bondNode(extra)
+
+	if len(b.entries) != bucketSize {
+		t.Fatalf("bucket entries should stay at %d after overflow insert, got %d", bucketSize, len(b.entries))
+	}
+	if len(b.replacements) != 1 {
+		t.Fatalf("expected 1 queued replacement, got %d", len(b.replacements))
+	}
+	if _, ok := tab.byID[extraID]; ok {
+		t.Fatalf("overflow node should not be indexed until it is promoted")
+	}
+}
+
+func TestClosestOrdersByDistance(t *testing.T) {
+	tab := newInitializedTestTable()
+
+	var target NodeID // 全0
+
+	far := NewNode(idWithPrefix(0), net.ParseIP("127.0.0.1"), 1, 1)    // dist=256
+	mid := NewNode(idWithPrefix(128), net.ParseIP("127.0.0.1"), 2, 2)  // dist=128
+	near := NewNode(idWithPrefix(255), net.ParseIP("127.0.0.1"), 3, 3) // dist=1
+
+	tab.bondNode(far)
+	tab.bondNode(mid)
+	tab.bondNode(near)
+
+	got := tab.closest(target, 2)
+	if len(got) != 2 {
+		t.Fatalf("expected 2 closest nodes, got %d", len(got))
+	}
+	if got[0].ID != near.ID || got[1].ID != mid.ID {
+		t.Fatalf("closest nodes not sorted by distance: got %v", got)
+	}
+}
+
+func TestChallengeEvictsOldestAndPromotesReplacement(t *testing.T) {
+	tab := newInitializedTestTable()
+	tab.self = failingPinger{}
+
+	bucketID := idWithPrefix(248)
+	bucketIdx := tab.bucketIndex(bucketID)
+
+	var oldestID NodeID
+	for i := 0; i < bucketSize; i++ {
+		id := bucketID
+		id[len(id)-1] |= byte(i + 1)
+		if i == 0 {
+			oldestID = id
+		}
+		n := NewNode(id, net.ParseIP("127.0.0.1"), 30000+i, 40000+i)
+		tab.bondNode(n)
+	}
+
+	extraID := bucketID
+	extraID[len(extraID)-1] |= byte(bucketSize + 1)
+	extra := NewNode(extraID, net.ParseIP("127.0.0.1"), 39999, 49999)
+	tab.bondNode(extra) // 桶已满，触发 go tab.challenge(bucketIdx, oldest)
+
+	b := tab.buckets[bucketIdx]
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		tab.mux.Lock()
+		settled := len(b.replacements) == 0
+		tab.mux.Unlock()
+		if settled {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	tab.mux.Lock()
+	defer tab.mux.Unlock()
+
+	if _, ok := tab.byID[oldestID]; ok {
+		t.Fatalf("oldest entry should have been evicted from byID")
+	}
+	for _, e := range b.entries {
+		if e.ID == oldestID {
+			t.Fatalf("oldest entry should have been evicted from bucket entries")
+		}
+	}
+
+	if _, ok := tab.byID[extraID]; !ok {
+		t.Fatalf("replacement should have been promoted into byID")
+	}
+	found := false
+	for _, e := range b.entries {
+		if e.ID == extraID {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("replacement should have been promoted into bucket entries")
+	}
+	if len(b.replacements) != 0 {
+		t.Fatalf("replacement cache should be drained, got %d entries", len(b.replacements))
+	}
+}
@@ -3,6 +3,7 @@ package discover
 import (
 	"bytes"
 	"container/list"
+	"crypto/ecdsa"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,6 +11,8 @@ import (
 	"log"
 	"net"
 	"time"
+
+	"go-blockchain/crypto"
 )
 
 const (
@@ -19,6 +22,9 @@ const (
 	replynodePacket
 )
 
+// Version 发现协议的版本号，信封格式变化时需要提升该值
+const Version = 1
+
 var (
 	expirationTime = 30 * time.Second
 )
@@ -27,6 +33,8 @@ var (
 	errPacketTimeout = errors.New("timeout")
 	errPacketHandle  = errors.New("handle packet error")
 	errListTimeout   = errors.New("queue time out")
+	errBadHash       = errors.New("bad packet hash or signature")
+	errBadVersion    = errors.New("protocol version mismatch")
 )
 
 type udp struct {
@@ -36,6 +44,7 @@ type udp struct {
 	self     endpoint
 	tab      *Table
 	Id       NodeID
+	priv     *ecdsa.PrivateKey
 	exit     chan struct{}
 }
 
@@ -43,7 +52,7 @@ type udp struct {
 type pending struct {
 	typ      byte
 	deadline int64
-	callback func(v interface{}) bool
+	callback func(v interface{}, from NodeID) bool
 	errch    chan error
 }
 
@@ -51,6 +60,7 @@ type pending struct {
 type gotreply struct {
 	typ     byte
 	data    interface{}
+	from    NodeID // 发送方经签名验证过的真实NodeID
 	matched chan bool
 }
 
@@ -87,7 +97,9 @@ func newUDP(c conn, cfg Config) *udp {
 		conn:     c,
 		pending:  make(chan *pending, 10),
 		gotreply: make(chan gotreply, 10),
-		Id:       StringID(cfg.Id),
+		self:     endpoint{TCP: cfg.TCPPort},
+		Id:       PubkeyToNodeID(&cfg.PrivateKey.PublicKey),
+		priv:     cfg.PrivateKey,
 		exit:     make(chan struct{}),
 	}
 
@@ -130,7 +142,7 @@ func (t *udp) taskLoop() {
 				fmt.Println(">", r.typ, v.typ)
 				if r.typ == v.typ {
 					// 处理回调函数
-					if v.callback(r.data) {
+					if v.callback(r.data, r.from) {
 						v.errch <- nil
 						plist.Remove(pl)
 					}
@@ -157,25 +169,36 @@ func (t *udp) readLoop() {
 			continue
 		}
 		log.Println("recv handle <=", from)
-		if err = t.handleRequest(buf[:nbytes], from); err != nil {
-			log.Println(err)
-			// 处理失败
-		}
+		// 拷贝一份数据再丢给goroutine处理，避免buf被下一次Read覆盖；
+		// 处理过程可能因为bond而阻塞等待pong，不能占住readLoop。
+		data := make([]byte, nbytes)
+		copy(data, buf[:nbytes])
+		go t.handleRequest(data, from)
 	}
 }
 
 func (t *udp) handleRequest(buf []byte, to *net.UDPAddr) error {
-	pack, fromID, err := decodePacket(buf)
+	pack, fromID, hash, err := decodePacket(buf)
 	if err != nil {
 		return err
 	}
 	//log.Println("fromID", fromID)
-	err = pack.handle(t, fromID, to)
+	err = pack.handle(t, fromID, to, hash)
 	return err
 }
 
-func (t *udp) sendMessage(typ byte, to *net.UDPAddr, pack packet) {
-	data := encodePacket(t.Id, typ, pack)
+// sendMessage 发送数据包，返回信封哈希，用于ping/pong的应答校验
+func (t *udp) sendMessage(typ byte, to *net.UDPAddr, pack packet) []byte {
+	data, hash, err := encodePacket(t.priv, typ, pack)
+	if err != nil {
+		log.Println("encode packet error:", err)
+		return nil
+	}
+	t.write(data, to)
+	return hash
+}
+
+func (t *udp) write(data []byte, to *net.UDPAddr) {
 	_, err := t.conn.WriteToUDP(data, to)
 	if err != nil {
 		log.Println("write to udp error:", err)
@@ -183,7 +206,7 @@ func (t *udp) sendMessage(typ byte, to *net.UDPAddr, pack packet) {
 }
 
 // 添加待处理的事件
-func (t *udp) addPending(typ byte, call func(v interface{}) bool) <-chan error {
+func (t *udp) addPending(typ byte, call func(v interface{}, from NodeID) bool) <-chan error {
 	ch := make(chan error, 1)
 	select {
 	case t.pending <- &pending{typ: typ, callback: call, errch: ch}:
@@ -194,11 +217,11 @@ func (t *udp) addPending(typ byte, call func(v interface{}) bool) <-chan error {
 	return ch
 }
 
-// 处理返回的结果
-func (t *udp) handleReply(typ byte, pack packet) bool {
+// 处理返回的结果，from为发送方经签名验证过的真实NodeID
+func (t *udp) handleReply(typ byte, pack packet, from NodeID) bool {
 	ch := make(chan bool, 1)
 	select {
-	case t.gotreply <- gotreply{typ: typ, data: pack, matched: ch}:
+	case t.gotreply <- gotreply{typ: typ, data: pack, from: from, matched: ch}:
 		return <-ch
 	case <-t.exit:
 		return true
@@ -207,18 +230,21 @@ func (t *udp) handleReply(typ byte, pack packet) bool {
 
 type (
 	ping struct {
-		From   endpoint
-		To     endpoint
-		Expire int64
+		Version uint
+		From    endpoint
+		To      endpoint
+		Expire  int64
 	}
 
 	pong struct {
-		To     endpoint
-		Expire int64
+		From     endpoint // 应答方自己的endpoint，让对端学到它真实的TCP端口
+		To       endpoint
+		Expire   int64
+		ReplyTok []byte // 对应ping数据包的哈希，用于确认这是对应请求的应答
 	}
 
 	findnode struct {
-		FromID string
+		Target NodeID
 		Expire int64
 	}
 
@@ -230,89 +256,135 @@ type (
 
 // 数据包
 type packet interface {
-	handle(t *udp, fromID NodeID, to *net.UDPAddr) error
+	handle(t *udp, fromID NodeID, to *net.UDPAddr, hash []byte) error
 }
 
 // 处理ping数据包
-func (p *ping) handle(t *udp, fromID NodeID, to *net.UDPAddr) error {
+func (p *ping) handle(t *udp, fromID NodeID, to *net.UDPAddr, hash []byte) error {
 	if expire(p.Expire) {
 		return Error("ping", errPacketTimeout)
 	}
 
-	reply := pong{Expire: time.Now().Add(expirationTime).Unix()}
+	if p.Version != Version {
+		// 版本不一致，不回pong，让对端的bond自然超时失败
+		return Error("ping", errBadVersion)
+	}
+
+	reply := pong{
+		From:     t.self, // 带上本地TCP端口，让pinger能学到我们真实的业务端口
+		Expire:   time.Now().Add(expirationTime).Unix(),
+		ReplyTok: hash,
+	}
 
 	log.Println("handle ping", "from", to, ";send pong")
 	t.sendMessage(pongPacket, to, &reply)
 	log.Println("send ok")
-	// if !t.handleReply(pongPacket, p) {
-	// 	return errPacketHandle
-	// }
 	return nil
 }
 
 // 处理pong数据包
-func (p *pong) handle(t *udp, fromID NodeID, to *net.UDPAddr) error {
+func (p *pong) handle(t *udp, fromID NodeID, to *net.UDPAddr, hash []byte) error {
 	if expire(p.Expire) {
 		return Error("pong", errPacketTimeout)
 	}
 
 	log.Println("handle pong", "from", to)
-	if !t.handleReply(pongPacket, p) {
+	if !t.handleReply(pongPacket, p, fromID) {
 		return Error("pong", errPacketHandle)
 	}
+	t.tab.recordPong(fromID)
 	return nil
 }
 
-func (p *findnode) handle(t *udp, fromID NodeID, to *net.UDPAddr) error {
-	// todo
+func (p *findnode) handle(t *udp, fromID NodeID, to *net.UDPAddr, hash []byte) error {
 	if expire(p.Expire) {
 		return Error("findnode", errPacketTimeout)
 	}
 
+	// 只有完成bond认证的发送方才能得到回复，避免伪造地址污染路由表
+	n := t.tab.bond(fromID, to)
+	if n == nil {
+		return Error("findnode", errors.New("unbonded sender"))
+	}
+
 	log.Println("handle findnode <=", "from", to)
-	n := NewNode(fromID, to.IP, to.Port, to.Port)
-	t.tab.bondNode(n)
 	// 返回reply
 	reply := replynode{
 		Expire: time.Now().Add(expirationTime).Unix(),
 	}
 
 	// 取附近的node
-	reply.Nodes = t.tab.closest()
+	reply.Nodes = t.tab.closest(p.Target, bucketSize)
 	log.Println("返回节点: ", reply.Nodes)
 	t.sendMessage(replynodePacket, to, &reply)
 	return nil
 }
 
-func (p *replynode) handle(t *udp, fromID NodeID, to *net.UDPAddr) error {
+func (p *replynode) handle(t *udp, fromID NodeID, to *net.UDPAddr, hash []byte) error {
 	if expire(p.Expire) {
 		return Error("replynode", errPacketTimeout)
 	}
 
 	log.Println("handle replynode:", p.Nodes)
-	if !t.handleReply(replynodePacket, p) {
+	if !t.handleReply(replynodePacket, p, fromID) {
 		return Error("replynode", errPacketHandle)
 	}
 
 	return nil
 }
 
-// 编码
-func encodePacket(id NodeID, typ byte, pack packet) []byte {
-	buf := new(bytes.Buffer)
-	buf.WriteByte(typ)
-	// 添加ID
-	buf.Write(id[:])
-	encoder := json.NewEncoder(buf)
-	encoder.Encode(pack)
+// 信封结构： hash(32) + sig(65) + typ(1) + payload
+const (
+	hashLen = 32
+	sigLen  = 65
+)
 
-	return buf.Bytes()
+// 编码，对typ+payload做签名，hash为sig+typ+payload的keccak256，
+// 既用作完整性校验，也被pong的ReplyTok引用
+func encodePacket(priv *ecdsa.PrivateKey, typ byte, pack packet) ([]byte, []byte, error) {
+	payload, err := json.Marshal(pack)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	body := append([]byte{typ}, payload...)
+	sig, err := crypto.Sign(crypto.Keccak256(body), priv)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hash := crypto.Keccak256(sig, body)
+
+	buf := new(bytes.Buffer)
+	buf.Write(hash)
+	buf.Write(sig)
+	buf.Write(body)
+	return buf.Bytes(), hash, nil
 }
 
-// 解码
-func decodePacket(buf []byte) (packet, NodeID, error) {
+// 解码，校验hash后从签名恢复发送方公钥，公钥哈希即为fromID
+func decodePacket(buf []byte) (packet, NodeID, []byte, error) {
+	var fromID NodeID
+	if len(buf) < hashLen+sigLen+1 {
+		return nil, fromID, nil, errBadHash
+	}
+
+	hash := buf[:hashLen]
+	sig := buf[hashLen : hashLen+sigLen]
+	body := buf[hashLen+sigLen:]
+
+	if !bytes.Equal(hash, crypto.Keccak256(sig, body)) {
+		return nil, fromID, nil, errBadHash
+	}
+
+	pub, err := crypto.SigToPub(crypto.Keccak256(body), sig)
+	if err != nil {
+		return nil, fromID, nil, errBadHash
+	}
+	fromID = PubkeyToNodeID(pub)
+
 	var pack packet
-	typ := buf[0]
+	typ := body[0]
 	switch typ {
 	case pingPacket:
 		pack = new(ping)
@@ -324,17 +396,11 @@ func decodePacket(buf []byte) (packet, NodeID, error) {
 		pack = new(replynode)
 	}
 
-	// 获取发送方ID
-	var fromID NodeID
-	copy(fromID[:], buf[1:17])
-
-	buffer := bytes.NewBuffer(buf[17:])
-	decoder := json.NewDecoder(buffer)
-	err := decoder.Decode(pack)
-	if err != nil {
-		return nil, fromID, err
+	decoder := json.NewDecoder(bytes.NewBuffer(body[1:]))
+	if err := decoder.Decode(pack); err != nil {
+		return nil, fromID, nil, err
 	}
-	return pack, fromID, nil
+	return pack, fromID, hash, nil
 }
 
 func expire(ts int64) bool {
@@ -345,21 +411,31 @@ func Error(typ string, err error) error {
 	return fmt.Errorf("%s:%v", typ, err)
 }
 
-func (t *udp) findnode(to *net.UDPAddr) []*Node {
-	var nodes []*Node
-	errc := t.addPending(replynodePacket, func(v interface{}) bool {
+func (t *udp) findnode(to *net.UDPAddr, target NodeID) []*Node {
+	errc := t.addPending(replynodePacket, func(v interface{}, from NodeID) bool {
 		// 处理接收到的node
 		rn := v.(*replynode)
 		log.Println("处理replynode:", rn.Nodes)
 		for _, n := range rn.Nodes {
-			if n.Validate() {
-				nodes = append(nodes, n)
+			if !n.Validate() {
+				continue
 			}
+			// 先bond再采信，避免把未验证可达性的节点加入路由表。
+			// 必须异步执行：这个回调是taskLoop在自己的gotreply分支里
+			// 同步调用的，而bond会阻塞等待一次新的ping得到pong——那次
+			// pong同样要靠taskLoop转回循环顶部才能被匹配和交付，如果
+			// 在这里同步等待，taskLoop就把自己困住了，连别的、本该
+			// 瞬间完成的ping也会被一起拖死。bond成功的节点会通过
+			// tab.Subscribe()异步通知上层，这里不再同步收集返回值。
+			n := n
+			addr := &net.UDPAddr{IP: n.IP, Port: n.UDPPort}
+			go t.tab.bond(n.ID, addr)
 		}
 		return true
 	})
 
 	p := findnode{
+		Target: target,
 		Expire: time.Now().Add(expirationTime).Unix(),
 	}
 
@@ -370,26 +446,46 @@ func (t *udp) findnode(to *net.UDPAddr) []*Node {
 		log.Println("err:", err)
 		return nil
 	}
-	log.Println("find nodes:", nodes)
-	return nodes
+	return nil
 }
 
-func (t *udp) ping(to *net.UDPAddr) error {
-	//t.addPending(pongPacket, func(v interface{}) bool { return true })
-
+// ping 向to发起bonding握手，返回对端应答的pong中带回的真实TCP端口
+// (对端未填写时为0)以及从签名恢复出的对端真实NodeID。调用方应在TCP
+// 端口未知时回退到UDP发现端口，并且只信任这里返回的NodeID——而不是
+// 自己原先假定的id，因为后者可能只是一个占位符，或者是别的节点转述
+// 来的、未必准确的身份。
+func (t *udp) ping(to *net.UDPAddr) (int, NodeID, error) {
 	p := ping{
-		Expire: time.Now().Add(expirationTime).Unix(),
+		Version: Version,
+		Expire:  time.Now().Add(expirationTime).Unix(),
 	}
 
-	errc := t.addPending(pongPacket, func(v interface{}) bool { return true })
-
 	log.Println("ping to", to)
-	t.sendMessage(pingPacket, to, &p)
+	data, hash, err := encodePacket(t.priv, pingPacket, &p)
+	if err != nil {
+		log.Println("encode packet error:", err)
+		return 0, NodeID{}, err
+	}
 
-	err := <-errc
-	return err
+	var tcpPort int
+	var realID NodeID
+	// 先注册pending回调，再发送，避免pong先于注册到达导致匹配失败
+	errc := t.addPending(pongPacket, func(v interface{}, from NodeID) bool {
+		pg, ok := v.(*pong)
+		if !ok || !bytes.Equal(pg.ReplyTok, hash) {
+			return false
+		}
+		tcpPort = pg.From.TCP
+		realID = from
+		return true
+	})
+
+	t.write(data, to)
+
+	err = <-errc
+	return tcpPort, realID, err
 }
 
 func (t *udp) waitping() error {
-	return <-t.addPending(pongPacket, func(v interface{}) bool { return true })
+	return <-t.addPending(pongPacket, func(v interface{}, from NodeID) bool { return true })
 }